@@ -1,87 +1,304 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 
 	"github.com/coreos/container-images/tectonic-error-server/binassets"
 )
 
 var (
-	addr = flag.String("addr", "0.0.0.0:8080", "address to serve default backend.")
+	addr        = flag.String("addr", "0.0.0.0:8080", "address to serve default backend.")
+	templateDir = flag.String("templatedir", "", "directory of override error page templates (error.html, error.json, error.txt); walked at startup, falling back to the built-in defaults for any file not found there")
 
-	errorPage = binassets.MustAsset("error.html")
 	indexPage = binassets.MustAsset("index.html")
+
+	// overrideTemplates holds any templates found under -templatedir, keyed
+	// by file name, taking precedence over the bundled binassets.
+	overrideTemplates map[string][]byte
+
+	htmlTmpl  *template.Template
+	jsonTmpl  *texttemplate.Template
+	plainTmpl *texttemplate.Template
+
+	logger = logrus.New()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "errorserver_requests_total",
+		Help: "Total number of error pages served, by status code and response format.",
+	}, []string{"code", "format"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "errorserver_request_duration_seconds",
+		Help: "Latency of serving an error page, by status code.",
+	}, []string{"code"})
+	templateRenderErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "errorserver_template_render_errors_total",
+		Help: "Total number of errors encountered while rendering an error page template.",
+	})
 )
 
+func init() {
+	logger.Formatter = &logrus.JSONFormatter{}
+	prometheus.MustRegister(requestsTotal, requestDuration, templateRenderErrorsTotal)
+}
+
+// errMessages maps the status codes the default backend knows how to render
+// to their message text. Codes outside this set fall back to serving
+// indexPage, matching the previous behavior.
+var errMessages = map[int]string{
+	400: "Bad Request",
+	401: "Unauthorized Access",
+	403: "Forbidden",
+	404: "Not Found",
+	500: "Internal Server Error",
+	503: "Service Unavailable",
+	504: "Gateway Time-out",
+}
+
+// templateData is populated from the headers nginx-ingress sets on a
+// default-backend request and passed to the HTML/JSON/plain text templates.
 type templateData struct {
-	ErrCode int
-	ErrMsg  string
+	Code        int    `json:"code"`
+	Message     string `json:"message"`
+	RequestID   string `json:"requestID"`
+	Format      string `json:"format"`
+	OriginalURI string `json:"originalURI"`
+	Namespace   string `json:"namespace"`
+	IngressName string `json:"ingressName"`
 }
 
-func handleErrorPage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.New("").Parse(string(errorPage))
+// loadTemplateOverrides walks dir, if non-empty, and returns its files keyed
+// by name so they can take precedence over the bundled binassets.
+func loadTemplateOverrides(dir string) (map[string][]byte, error) {
+	overrides := make(map[string][]byte)
+	if dir == "" {
+		return overrides, nil
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		overrides[info.Name()] = data
+		return nil
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to walk template directory %q: %v", dir, err)
 	}
+	return overrides, nil
+}
 
-	var errorCode int
-	xcodeHeader := r.Header.Get("X-Code")
-	if xcodeHeader != "" {
-		errorCode, err = strconv.Atoi(xcodeHeader)
-		if err != nil {
-			msg := "unable to get error code"
-			data := templateData{500, msg}
-			w.WriteHeader(http.StatusInternalServerError)
-			if err := tmpl.Execute(w, data); err != nil {
-				log.Println(msg)
-			}
-			return
+// defaultPlainTemplate is used for the text/plain error response when
+// -templatedir doesn't override it. Unlike error.html, error.txt was never
+// added to the binassets bundle, so there's no baked-in asset to fall back
+// to.
+const defaultPlainTemplate = "{{.Message}} ({{.Code}})\n"
+
+// templateFuncs are available to templates loaded from -templatedir so that
+// header-derived fields (e.g. X-Original-URI, which is attacker-controlled)
+// can be safely escaped when interpolated into a non-HTML format.
+var templateFuncs = texttemplate.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// loadAsset returns the named override template if -templatedir provided
+// one, falling back to the bundled binassets.
+func loadAsset(name string) []byte {
+	if data, ok := overrideTemplates[name]; ok {
+		return data
+	}
+	return binassets.MustAsset(name)
+}
+
+// loadOverride returns the named template from -templatedir, if provided.
+func loadOverride(name string) ([]byte, bool) {
+	data, ok := overrideTemplates[name]
+	return data, ok
+}
+
+// loadTemplates (re-)parses the HTML, JSON, and plain text error templates.
+//
+// error.html is always bundled in binassets, so it's only ever replaced by
+// an override. error.json and error.txt have no bundled asset: without an
+// override, JSON responses are instead marshaled directly with
+// encoding/json (jsonTmpl is left nil, see renderError) and plain text
+// responses fall back to defaultPlainTemplate. This also keeps
+// responses safe from injection via attacker-controlled fields like
+// X-Original-URI; an override template must use the `json` func to escape
+// them.
+func loadTemplates() error {
+	var err error
+	if htmlTmpl, err = template.New("error.html").Parse(string(loadAsset("error.html"))); err != nil {
+		return fmt.Errorf("failed to parse error.html: %v", err)
+	}
+
+	jsonTmpl = nil
+	if src, ok := loadOverride("error.json"); ok {
+		if jsonTmpl, err = texttemplate.New("error.json").Funcs(templateFuncs).Parse(string(src)); err != nil {
+			return fmt.Errorf("failed to parse error.json: %v", err)
 		}
 	}
 
-	var errMsg string
-	switch errorCode {
-	case 400:
-		errMsg = "Bad Request"
-	case 401:
-		errMsg = "Unauthorized Access"
-	case 403:
-		errMsg = "Forbidden"
-	case 404:
-		errMsg = "Not Found"
-	case 500:
-		errMsg = "Internal Server Error"
-	case 503:
-		errMsg = "Service Unavailable"
-	case 504:
-		errMsg = "Gateway Time-out"
+	plainSrc, ok := loadOverride("error.txt")
+	if !ok {
+		plainSrc = []byte(defaultPlainTemplate)
+	}
+	if plainTmpl, err = texttemplate.New("error.txt").Funcs(templateFuncs).Parse(string(plainSrc)); err != nil {
+		return fmt.Errorf("failed to parse error.txt: %v", err)
+	}
+	return nil
+}
+
+// negotiateFormat picks the response format for an error page, normalized to
+// one of "application/json", "text/plain", or "text/html". nginx-ingress
+// sets X-Format to the content-type the original client requested, so that
+// takes priority; otherwise we fall back to the standard Accept header.
+func negotiateFormat(r *http.Request) string {
+	requested := r.Header.Get("X-Format")
+	if requested == "" {
+		requested = r.Header.Get("Accept")
+	}
+	switch {
+	case strings.Contains(requested, "application/json"):
+		return "application/json"
+	case strings.Contains(requested, "text/plain"):
+		return "text/plain"
+	default:
+		return "text/html"
+	}
+}
+
+// renderError renders data using the template for format, returning the
+// rendered body and the content type it should be served with.
+func renderError(format string, data templateData) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "application/json":
+		if jsonTmpl != nil {
+			err = jsonTmpl.Execute(&buf, data)
+		} else {
+			var b []byte
+			b, err = json.Marshal(data)
+			buf.Write(b)
+		}
+	case "text/plain":
+		err = plainTmpl.Execute(&buf, data)
 	default:
-		w.WriteHeader(404)
+		format = "text/html"
+		err = htmlTmpl.Execute(&buf, data)
+	}
+	return buf.Bytes(), format, err
+}
+
+func handleErrorPage(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	data := templateData{
+		RequestID:   r.Header.Get("X-Request-ID"),
+		Format:      r.Header.Get("X-Format"),
+		OriginalURI: r.Header.Get("X-Original-URI"),
+		Namespace:   r.Header.Get("X-Namespace"),
+		IngressName: r.Header.Get("X-Ingress-Name"),
+	}
+
+	if xcode := r.Header.Get("X-Code"); xcode != "" {
+		code, err := strconv.Atoi(xcode)
+		if err != nil {
+			logger.WithField("xCode", xcode).WithError(err).Warn("unable to parse X-Code header")
+			code = http.StatusInternalServerError
+		}
+		data.Code = code
+	}
+
+	format := negotiateFormat(r)
+
+	msg, ok := errMessages[data.Code]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
 		w.Write(indexPage)
+		recordRequest(data, http.StatusNotFound, format, start)
 		return
 	}
+	data.Message = msg
 
-	data := templateData{errorCode, errMsg}
-	w.WriteHeader(errorCode)
-	if err := tmpl.Execute(w, data); err != nil {
-		log.Printf("Unable to execute template.")
+	body, contentType, err := renderError(format, data)
+	if err != nil {
+		templateRenderErrorsTotal.Inc()
+		logger.WithFields(logrus.Fields{"code": data.Code, "format": contentType}).WithError(err).Error("unable to render error page template")
+		w.WriteHeader(http.StatusInternalServerError)
+		recordRequest(data, http.StatusInternalServerError, contentType, start)
 		return
 	}
 
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(data.Code)
+	w.Write(body)
+	recordRequest(data, data.Code, contentType, start)
+}
+
+// recordRequest updates the request metrics and emits one structured log
+// line for a served error page, given the status code it was actually
+// served with (which may differ from data.Code: unknown codes are served as
+// 404, and a failed render as 500).
+func recordRequest(data templateData, servedCode int, format string, start time.Time) {
+	duration := time.Since(start)
+	codeStr := strconv.Itoa(servedCode)
+	requestsTotal.WithLabelValues(codeStr, format).Inc()
+	requestDuration.WithLabelValues(codeStr).Observe(duration.Seconds())
+
+	logger.WithFields(logrus.Fields{
+		"code":         servedCode,
+		"xCode":        data.Code,
+		"format":       format,
+		"originalURI":  data.OriginalURI,
+		"requestID":    data.RequestID,
+		"durationSecs": duration.Seconds(),
+	}).Info("served error page")
 }
 
 func main() {
 	flag.Parse()
+
+	var err error
+	if overrideTemplates, err = loadTemplateOverrides(*templateDir); err != nil {
+		logger.WithError(err).Fatal("failed to load template overrides")
+	}
+	if err := loadTemplates(); err != nil {
+		logger.WithError(err).Fatal("failed to load error page templates")
+	}
+
 	http.HandleFunc("/", handleErrorPage)
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "ok")
 	})
-	http.ListenAndServe(fmt.Sprintf("%s", *addr), nil)
+	http.Handle("/metrics", promhttp.Handler())
+	logger.WithField("addr", *addr).Info("serving default backend")
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		logger.WithError(err).Fatal("default backend exited")
+	}
 }
@@ -0,0 +1,15 @@
+package test
+
+import "context"
+
+// StatsBackend is a sink that the stats-emitter reports cluster extensions
+// to. Implementations know how to reach their backend (BigQuery, Prometheus,
+// InfluxDB, ...) and translate whatever storage format it uses into the
+// plain extension name/value pairs the tests assert on.
+type StatsBackend interface {
+	// FetchExtensions returns the extension name/value pairs recorded for
+	// the given cluster ID.
+	FetchExtensions(ctx context.Context, clusterID string) (map[string]string, error)
+	// Name identifies the backend, e.g. for use in test output.
+	Name() string
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// bqre is a regular expression for parsing BigQuery specs.
+var bqre = regexp.MustCompile(`^bigquery://([^.]+)\.([^.]+)\.([^.]+)$`)
+
+// bigQueryBackend verifies stats extensions recorded in a BigQuery table.
+type bigQueryBackend struct {
+	project, dataset, table string
+}
+
+// newBigQueryBackend parses a spec formatted as `bigquery://project.dataset.table`
+// and returns a backend that queries it.
+func newBigQueryBackend(spec string) (*bigQueryBackend, error) {
+	project, dataset, table, err := parseBigQuerySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &bigQueryBackend{project: project, dataset: dataset, table: table}, nil
+}
+
+// parseBigQuerySpec parses a spec formatted as `bigquery://project.dataset.table`.
+// The 3 string returns are project, dataset, and table respectively.
+// This will return an error if it does not believe the argument is a BigQuery spec,
+// or if it believes the argument is a biquery spec but it can't parse it properly.
+func parseBigQuerySpec(spec string) (string, string, string, error) {
+	subs := bqre.FindStringSubmatch(spec)
+	if len(subs) != 4 {
+		return "", "", "", fmt.Errorf("invalid BigQuery spec: %q", spec)
+	}
+	return subs[1], subs[2], subs[3], nil
+}
+
+func (b *bigQueryBackend) Name() string {
+	return fmt.Sprintf("bigquery://%s.%s.%s", b.project, b.dataset, b.table)
+}
+
+// FetchExtensions queries BigQuery for the extension name/value pairs recorded
+// for clusterID.
+//
+// This assumes that:
+//  a) a GCE ServiceAccount has been created for this app
+//  b) the ServiceAccount is an owner of the dataset for this app
+//  c) the credentials for the ServiceAccount are in a file
+//  d) env GOOGLE_APPLICATION_CREDENTIALS=<path to credentials file>
+func (b *bigQueryBackend) FetchExtensions(ctx context.Context, clusterID string) (map[string]string, error) {
+	bq, err := bigquery.NewClient(ctx, b.project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %v", err)
+	}
+	q := bq.Query(`SELECT
+ extensions.name,
+ extensions.value,
+FROM
+  FLATTEN([` + fmt.Sprintf("%s:%s.%s", b.project, b.dataset, b.table) + `], extensions)
+WHERE
+ clusterID = '` + clusterID + `'
+GROUP BY
+ extensions.name,
+ extensions.value`)
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read query results: %v", err)
+	}
+	found := make(map[string]string)
+	for {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next row: %v", err)
+		}
+		n, _ := row[extensionsNameKey]
+		name, ok := n.(string)
+		if !ok {
+			return nil, errors.New("expected extension name to be a string")
+		}
+		v, _ := row[extensionsValueKey]
+		value, ok := v.(string)
+		if !ok {
+			return nil, errors.New("expected extension value to be a string")
+		}
+		found[name] = value
+	}
+	return found, nil
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// statsEmitterExecCommand is run inside the tectonic-stats-emitter container
+// to read back the last time it successfully reported stats. It falls back
+// to the image's HTTP healthz endpoint if the timestamp file isn't present.
+const statsEmitterExecCommand = "cat /var/run/stats-emitter/last-report-timestamp 2>/dev/null || wget -qO- http://localhost:9090/healthz/last-report"
+
+// testStatsEmitterExec verifies, by executing a probe command directly in
+// the stats-emitter container, that it reported stats within timeout. This
+// is more robust than the log-substring check in testGetStatsEmitterLogs
+// since it doesn't depend on a specific log message surviving format
+// changes, but it requires a probe endpoint baked into the image, so it's
+// gated behind -execprobe.
+func testStatsEmitterExec(t *testing.T) {
+	if !execProbe {
+		t.Skip("skipping because -execprobe is not set")
+		return
+	}
+
+	err := wait.Poll(5*time.Second, timeout, testPointToCondition(getStatsEmitterExecProbe, t))
+	if err != nil {
+		t.Fatalf("Failed to verify stats-emitter liveness via exec probe in %v.", timeout)
+	}
+	t.Log("Successfully verified stats-emitter liveness via exec probe.")
+}
+
+func getStatsEmitterExecProbe(t *testing.T) error {
+	c, err := newClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Kubernetes client: %v", err)
+	}
+	config, err := restConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get Kubernetes cluster config: %v", err)
+	}
+
+	namespace := "tectonic-system"
+	podPrefix := "tectonic-stats-emitter"
+	selector := &meta_v1.LabelSelector{MatchLabels: map[string]string{"k8s-app": podPrefix}}
+	pod, err := findPod(c, namespace, selector)
+	if err != nil {
+		return fmt.Errorf("failed to find %s pod: %v", podPrefix, err)
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return fmt.Errorf("%s pod has no containers", pod.Name)
+	}
+	container := pod.Spec.Containers[0].Name
+
+	out, err := execInPod(c, config, namespace, pod.Name, container, []string{"sh", "-c", statsEmitterExecCommand})
+	if err != nil {
+		return fmt.Errorf("failed to exec probe in %s/%s: %v", pod.Name, container, err)
+	}
+
+	reported, err := time.Parse(time.RFC3339, strings.TrimSpace(out))
+	if err != nil {
+		return fmt.Errorf("failed to parse last report timestamp %q: %v", out, err)
+	}
+	if since := time.Since(reported); since > timeout {
+		return fmt.Errorf("last stats report was %v ago, exceeding timeout %v", since, timeout)
+	}
+	return nil
+}
+
+// findPod returns the first pod matching selector in namespace.
+func findPod(c *kubernetes.Clientset, namespace string, selector *meta_v1.LabelSelector) (*v1.Pod, error) {
+	ls, err := meta_v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %v", err)
+	}
+	pods, err := c.Core().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: ls.String()})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods: %v", err)
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("failed to find pods matching selector in namespace %q", namespace)
+	}
+	return &pods.Items[0], nil
+}
+
+// execInPod runs command inside container of pod podName and returns its
+// stdout. Stderr is only reported as part of the error if the exec fails.
+func execInPod(c *kubernetes.Clientset, config *rest.Config, namespace, podName, container string, command []string) (string, error) {
+	req := c.Core().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		Param("container", container)
+
+	req.VersionedParams(&v1.PodExecOptions{
+		Container: container,
+		Command:   command,
+		Stdout:    true,
+		Stderr:    true,
+	}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to build executor: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return "", fmt.Errorf("exec stream failed: %v (stderr: %s)", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
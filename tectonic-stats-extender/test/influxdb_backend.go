@@ -0,0 +1,101 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// influxdbre is a regular expression for parsing InfluxDB specs.
+var influxdbre = regexp.MustCompile(`^influxdb://([^/]+)/([^/]+)/(.+)$`)
+
+// influxDBBackend verifies stats extensions recorded in an InfluxDB
+// database, reached through the apiserver's service proxy.
+type influxDBBackend struct {
+	namespace, service, database string
+}
+
+// newInfluxDBBackend parses a spec formatted as
+// `influxdb://namespace/service/database`, e.g.
+// `influxdb://tectonic-system/influxdb:api/tectonic`, and returns a backend
+// that queries it through the apiserver proxy.
+func newInfluxDBBackend(spec string) (*influxDBBackend, error) {
+	subs := influxdbre.FindStringSubmatch(spec)
+	if len(subs) != 4 {
+		return nil, fmt.Errorf("invalid InfluxDB spec: %q", spec)
+	}
+	return &influxDBBackend{namespace: subs[1], service: subs[2], database: subs[3]}, nil
+}
+
+func (b *influxDBBackend) Name() string {
+	return fmt.Sprintf("influxdb://%s/%s/%s", b.namespace, b.service, b.database)
+}
+
+// influxDBQueryResponse is the subset of an InfluxDB HTTP API query response
+// that we care about.
+type influxDBQueryResponse struct {
+	Results []struct {
+		Series []struct {
+			Columns []string        `json:"columns"`
+			Values  [][]interface{} `json:"values"`
+		} `json:"series"`
+	} `json:"results"`
+}
+
+// FetchExtensions queries InfluxDB, through the apiserver's proxy to the
+// InfluxDB service, for the extension name/value pairs recorded for
+// clusterID.
+func (b *influxDBBackend) FetchExtensions(ctx context.Context, clusterID string) (map[string]string, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes client: %v", err)
+	}
+
+	query := fmt.Sprintf(`SELECT name,value FROM extensions WHERE clusterID = '%s'`, clusterID)
+	raw, err := c.Core().RESTClient().Get().
+		Namespace(b.namespace).
+		Resource("services").
+		Name(b.service).
+		SubResource("proxy").
+		Suffix("query").
+		Param("db", b.database).
+		Param("q", query).
+		Context(ctx).
+		DoRaw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query InfluxDB: %v", err)
+	}
+
+	var resp influxDBQueryResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse InfluxDB response: %v", err)
+	}
+
+	found := make(map[string]string)
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			nameCol, valueCol := -1, -1
+			for i, col := range series.Columns {
+				switch col {
+				case "name":
+					nameCol = i
+				case "value":
+					valueCol = i
+				}
+			}
+			if nameCol == -1 || valueCol == -1 {
+				continue
+			}
+			for _, row := range series.Values {
+				name, ok := row[nameCol].(string)
+				if !ok {
+					continue
+				}
+				value, _ := row[valueCol].(string)
+				found[name] = value
+			}
+		}
+	}
+	return found, nil
+}
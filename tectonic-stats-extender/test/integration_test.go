@@ -3,21 +3,18 @@ package test
 import (
 	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"regexp"
 	"strings"
 	"testing"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	"google.golang.org/api/iterator"
 	"k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -39,13 +36,49 @@ const (
 var (
 	// timeout is the maximum time for a test.
 	timeout time.Duration
-	// bigQuerySpec is the spec of the BigQuery table to test for cluster metrics.
-	bigQuerySpec string
+	// statsBackends is the set of backends to verify stats extensions
+	// against, as configured by repeated -statsbackend flags.
+	statsBackends []StatsBackend
+	// execProbe controls whether StatsEmitterExec, which requires a probe
+	// endpoint baked into the stats-emitter image, is run.
+	execProbe bool
 )
 
+// statsBackendValue adapts the repeatable -statsbackend flag to flag.Value,
+// appending each parsed backend to statsBackends.
+type statsBackendValue struct{}
+
+func (statsBackendValue) String() string { return "" }
+
+func (statsBackendValue) Set(spec string) error {
+	backend, err := newStatsBackend(spec)
+	if err != nil {
+		return err
+	}
+	statsBackends = append(statsBackends, backend)
+	return nil
+}
+
+// newStatsBackend parses a `-statsbackend` spec and returns the backend it
+// names. Specs are scheme-prefixed, e.g. `bigquery://project.dataset.table`,
+// `prometheus://namespace/service`, or `influxdb://namespace/service/database`.
+func newStatsBackend(spec string) (StatsBackend, error) {
+	switch {
+	case strings.HasPrefix(spec, "bigquery://"):
+		return newBigQueryBackend(spec)
+	case strings.HasPrefix(spec, "prometheus://"):
+		return newPrometheusBackend(spec)
+	case strings.HasPrefix(spec, "influxdb://"):
+		return newInfluxDBBackend(spec)
+	default:
+		return nil, fmt.Errorf("unrecognized stats backend spec: %q", spec)
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.DurationVar(&timeout, "timeout", 1*time.Minute, "maximum time for a test (default 1m)")
-	flag.StringVar(&bigQuerySpec, "bigqueryspec", "", "BigQuery Spec (formatted as `bigquery://project.dataset.table`)")
+	flag.Var(statsBackendValue{}, "statsbackend", "Stats backend to verify cluster metrics against (formatted as `bigquery://project.dataset.table`, `prometheus://namespace/service`, or `influxdb://namespace/service/database`); may be repeated")
+	flag.BoolVar(&execProbe, "execprobe", false, "additionally verify stats-emitter liveness by exec'ing a probe command in its container (requires an image with a probe endpoint)")
 	flag.Parse()
 
 	os.Exit(m.Run())
@@ -54,19 +87,29 @@ func TestMain(m *testing.M) {
 // Test is the only test suite run by default.
 func Test(t *testing.T) {
 	t.Run("StatsEmitterLogs", testGetStatsEmitterLogs)
-	t.Run("BigQueryData", testGetBigQueryData)
+	t.Run("StatsEmitterExec", testStatsEmitterExec)
+	t.Run("StatsBackends", testStatsBackends)
 }
 
-// newClient will attempt to produce a client from a config file
+// restConfig will attempt to produce a rest.Config from a config file
 // specified in the KUBECONFIG environment variable. If this environment
 // variable is empty, then `BuildConfigFromFlags` automatically tries to
 // get a config from the in-cluster configuration.
-func newClient() (*kubernetes.Clientset, error) {
+func restConfig() (*rest.Config, error) {
 	path := os.Getenv("KUBECONFIG")
 	config, err := clientcmd.BuildConfigFromFlags("", path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get Kubernetes cluster config: %v", err)
 	}
+	return config, nil
+}
+
+// newClient builds a Kubernetes clientset from restConfig.
+func newClient() (*kubernetes.Clientset, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
 	return kubernetes.NewForConfig(config)
 }
 
@@ -90,7 +133,8 @@ func getStatsEmitterLogs(t *testing.T) error {
 	expected := "report successfully sent"
 	namespace := "tectonic-system"
 	podPrefix := "tectonic-stats-emitter"
-	logs, err := validatePodLogging(c, namespace, podPrefix)
+	selector := &meta_v1.LabelSelector{MatchLabels: map[string]string{"k8s-app": podPrefix}}
+	logs, err := validatePodLogging(c, namespace, selector, podPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to gather logs for %s/%s, %v", namespace, podPrefix, err)
 	}
@@ -108,89 +152,65 @@ func testGetStatsEmitterLogs(t *testing.T) {
 	t.Log("Successfully verified stats-emitter success in logs.")
 }
 
-// getBigQueryData finds the Tectonic cluster ID from the Tectonic configmap
-// in Kubernetes and uses it, along with the provided BigQuery spec, to query
-// BigQuery for the metrics for the given cluster.
-func getBigQueryData(t *testing.T) error {
-	// Parse BigQuery spec.
-	project, dataset, table, err := parseBigQuerySpec(bigQuerySpec)
-	if err != nil {
-		return fmt.Errorf("failed to parse BigQuery spec: %v", err)
+// testStatsBackends finds the Tectonic cluster ID from the Tectonic
+// configmap in Kubernetes and, for each configured stats backend, verifies
+// in a parallel subtest that the cluster's stats extensions were recorded
+// there. Backends that aren't configured are skipped entirely.
+func testStatsBackends(t *testing.T) {
+	if len(statsBackends) == 0 {
+		t.Skip("skipping because no stats backends are configured")
+		return
 	}
-	// Get Tectonic cluster configuration.
+
 	cm, err := getTectonicClusterConfig(t)
 	if err != nil {
-		return fmt.Errorf("failed to get Tectonic cluster configuration: %v", err)
+		t.Fatalf("failed to get Tectonic cluster configuration: %v", err)
 	}
-	cid, ok := cm.Data["clusterID"]
+	clusterID, ok := cm.Data["clusterID"]
 	if !ok {
-		return errors.New("failed to find cluster ID in ConfigMap")
-	}
-	// Initialize BigQuery client.
-	ctx := context.Background()
-	// This assumes that:
-	//  a) a GCE ServiceAccount has been created for this app
-	//  b) the ServiceAccount is an owner of the dataset for this app
-	//  c) the credentials for the ServiceAccount are in a file
-	//  d) env GOOGLE_APPLICATION_CREDENTIALS=<path to credentials file>
-	bq, err := bigquery.NewClient(ctx, project)
-	if err != nil {
-		return fmt.Errorf("failed to create BigQuery client: %v", err)
+		t.Fatal("failed to find cluster ID in ConfigMap")
 	}
-	// Get cluster stats extensions from BigQuery.
-	q := bq.Query(`SELECT
- extensions.name,
- extensions.value,
-FROM
-  FLATTEN([` + fmt.Sprintf("%s:%s.%s", project, dataset, table) + `], extensions)
-WHERE
- clusterID = '` + cid + `'
-GROUP BY
- extensions.name,
- extensions.value`)
-	expected := make(map[string]string)
-	found := make(map[string]string)
+
 	// extensions is an array of the tested stats extensions.
 	var extensions = []string{accountIDExtension, certificatesStrategyExtension, installerPlatformExtension, tectonicUpdaterEnabledExtension}
+	expected := make(map[string]string)
 	for _, name := range extensions {
 		// Some extensions are not in the ConfigMap and so do not have
 		// expected values. Instead, we just expect them to be present
-		// in BigQuery and do not care about their values.
+		// in the backend and do not care about their values.
 		if value, ok := cm.Data[name]; ok {
 			expected[name] = value
 		}
 	}
-	it, err := q.Read(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to read query results: %v", err)
+
+	for _, backend := range statsBackends {
+		backend := backend
+		t.Run(backend.Name(), func(t *testing.T) {
+			t.Parallel()
+			check := func(t *testing.T) error {
+				return checkBackendExtensions(backend, clusterID, extensions, expected)
+			}
+			err := wait.Poll(10*time.Second, timeout, testPointToCondition(check, t))
+			if err != nil {
+				t.Fatalf("Failed to verify stats-emitter data in %s in %v.", backend.Name(), timeout)
+			}
+			t.Logf("Successfully verified stats-emitter data in %s.", backend.Name())
+		})
 	}
-	for {
-		var row map[string]bigquery.Value
-		err := it.Next(&row)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to get next row: %v", err)
-		}
-		n, _ := row[extensionsNameKey]
-		name, ok := n.(string)
-		if !ok {
-			return fmt.Errorf("expected extension name to be a string")
-		}
-		v, _ := row[extensionsValueKey]
-		value, ok := v.(string)
-		if !ok {
-			return fmt.Errorf("expected extension value to be a string")
-		}
-		found[name] = value
+}
+
+// checkBackendExtensions fetches clusterID's extensions from backend and
+// ensures extensions are present, matching expected where a value is known.
+func checkBackendExtensions(backend StatsBackend, clusterID string, extensions []string, expected map[string]string) error {
+	found, err := backend.FetchExtensions(context.Background(), clusterID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch extensions from %s: %v", backend.Name(), err)
 	}
-	// Ensure stats extensions are in BigQuery.
 	var wrong []string
 	for _, name := range extensions {
 		expectedValue, ok := expected[name]
 		// If the extension does not have an expected value,
-		// then just check if it is present in BigQuery at all.
+		// then just check if it is present in the backend at all.
 		if !ok {
 			if _, ok := found[name]; !ok {
 				wrong = append(wrong, fmt.Sprintf("did not find extension %q", name))
@@ -202,42 +222,11 @@ GROUP BY
 		}
 	}
 	if len(wrong) != 0 {
-		return fmt.Errorf("failed to find extensions in BigQuery results: %s", strings.Join(wrong, "; "))
+		return fmt.Errorf("failed to find extensions in %s results: %s", backend.Name(), strings.Join(wrong, "; "))
 	}
 	return nil
 }
 
-func testGetBigQueryData(t *testing.T) {
-	if bigQuerySpec == "" {
-		t.Skip("skipping because no BigQuery spec is defined")
-		return
-	}
-
-	err := wait.Poll(10*time.Second, timeout, testPointToCondition(getBigQueryData, t))
-	if err != nil {
-		t.Fatalf("Failed to verify stats-emitter data in BigQuery in %v.", timeout)
-	}
-	t.Log("Successfully verified stats-emitter data in BigQuery.")
-}
-
-// bqre is a regular expression for parse BigQuery specs.
-var bqre = regexp.MustCompile(`^bigquery://([^.]+)\.([^.]+)\.([^.]+)$`)
-
-// parseBigQuerySpec parses a spec formatted as `bigquery://project.dataset.table`.
-// The 3 string returns are project, dataset, and table respectively.
-// This will return an error if it does not believe the argument is a BigQuery spec,
-// or if it believes the argument is a biquery spec but it can't parse it properly.
-func parseBigQuerySpec(spec string) (string, string, string, error) {
-	if !strings.HasPrefix(spec, "bigquery://") {
-		return "", "", "", errors.New("BigQuery spec must begin with \"bigquery://\"")
-	}
-	subs := bqre.FindStringSubmatch(spec)
-	if len(subs) != 4 {
-		return "", "", "", fmt.Errorf("invalid BigQuery spec: %q", spec)
-	}
-	return subs[1], subs[2], subs[3], nil
-}
-
 // getTectonicClusterConfig gets the cluster's configuration from the tectonic-config ConfigMap.
 func getTectonicClusterConfig(t *testing.T) (*v1.ConfigMap, error) {
 	c, err := newClient()
@@ -253,17 +242,31 @@ func getTectonicClusterConfig(t *testing.T) (*v1.ConfigMap, error) {
 	return cm, nil
 }
 
-// validatePodLogging verifies that logs can be retrieved for a container in Pod.
-func validatePodLogging(c *kubernetes.Clientset, namespace, podPrefix string) ([]byte, error) {
+// validatePodLogging verifies that logs can be retrieved for every container
+// of every pod matching selector in namespace, and returns their aggregated
+// logs with each line tagged with its "podName/containerName" source so
+// callers can attribute a line to a specific container. If selector is nil,
+// pods are instead matched by podPrefix, for backwards compatibility with
+// callers that haven't been given labels to select on.
+func validatePodLogging(c *kubernetes.Clientset, namespace string, selector *meta_v1.LabelSelector, podPrefix string) ([]byte, error) {
 	var allLogs []byte
-	pods, err := c.Core().Pods(namespace).List(meta_v1.ListOptions{})
+
+	opt := meta_v1.ListOptions{}
+	if selector != nil {
+		ls, err := meta_v1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return allLogs, fmt.Errorf("invalid label selector: %v", err)
+		}
+		opt.LabelSelector = ls.String()
+	}
+	pods, err := c.Core().Pods(namespace).List(opt)
 	if err != nil {
 		return allLogs, fmt.Errorf("could not list pods: %v", err)
 	}
 
 	var found bool
 	for _, p := range pods.Items {
-		if !strings.HasPrefix(p.Name, podPrefix) {
+		if selector == nil && !strings.HasPrefix(p.Name, podPrefix) {
 			continue
 		}
 		found = true
@@ -272,29 +275,49 @@ func validatePodLogging(c *kubernetes.Clientset, namespace, podPrefix string) ([
 			return allLogs, fmt.Errorf("%s pod has no containers", p.Name)
 		}
 
-		opt := v1.PodLogOptions{
-			Container: p.Spec.Containers[0].Name,
-		}
-		result := c.Core().Pods(namespace).GetLogs(p.Name, &opt).Do()
-		if err := result.Error(); err != nil {
-			return allLogs, fmt.Errorf("failed to get pod logs: %v", err)
-		}
+		for _, container := range p.Spec.Containers {
+			opt := v1.PodLogOptions{
+				Container: container.Name,
+			}
+			result := c.Core().Pods(namespace).GetLogs(p.Name, &opt).Do()
+			if err := result.Error(); err != nil {
+				return allLogs, fmt.Errorf("failed to get logs for %s/%s: %v", p.Name, container.Name, err)
+			}
 
-		var statusCode int
-		result.StatusCode(&statusCode)
-		if statusCode/100 != 2 {
-			return allLogs, fmt.Errorf("expected 200 from log response, got %d", statusCode)
-		}
+			var statusCode int
+			result.StatusCode(&statusCode)
+			if statusCode/100 != 2 {
+				return allLogs, fmt.Errorf("expected 200 from log response for %s/%s, got %d", p.Name, container.Name, statusCode)
+			}
 
-		logs, err := result.Raw()
-		if err != nil {
-			return allLogs, fmt.Errorf("failed to read logs: %v", err)
-		}
+			logs, err := result.Raw()
+			if err != nil {
+				return allLogs, fmt.Errorf("failed to read logs for %s/%s: %v", p.Name, container.Name, err)
+			}
 
-		allLogs = append(allLogs, logs...)
+			allLogs = append(allLogs, tagLogLines(p.Name+"/"+container.Name, logs)...)
+		}
 	}
 	if !found {
-		return allLogs, fmt.Errorf("failed to find pods with prefix %q in namespace %q", podPrefix, namespace)
+		return allLogs, fmt.Errorf("failed to find pods matching selector in namespace %q", namespace)
 	}
 	return allLogs, nil
 }
+
+// tagLogLines prefixes each line of logs with "prefix: " so that a caller
+// reading the aggregated output of multiple containers can attribute any
+// line back to its source.
+func tagLogLines(prefix string, logs []byte) []byte {
+	logs = bytes.TrimRight(logs, "\n")
+	if len(logs) == 0 {
+		return nil
+	}
+
+	var tagged []byte
+	for _, line := range bytes.Split(logs, []byte("\n")) {
+		tagged = append(tagged, []byte(prefix+": ")...)
+		tagged = append(tagged, line...)
+		tagged = append(tagged, '\n')
+	}
+	return tagged
+}
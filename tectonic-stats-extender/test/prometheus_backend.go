@@ -0,0 +1,92 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// prometheusre is a regular expression for parsing Prometheus specs.
+var prometheusre = regexp.MustCompile(`^prometheus://([^/]+)/(.+)$`)
+
+// prometheusBackend verifies stats extensions recorded as Prometheus samples,
+// reached through the apiserver's service proxy.
+//
+// PROVISIONAL: this assumes tectonic-stats-emitter exposes a
+// `tectonic_stats_extension` metric labelled `clusterID`, `extension`, and
+// `extensionValue` (see FetchExtensions). That schema isn't defined anywhere
+// in this tree; it must be confirmed against (or used to define) the actual
+// metric stats-emitter registers before this backend is relied on against a
+// real cluster.
+type prometheusBackend struct {
+	namespace, service string
+}
+
+// newPrometheusBackend parses a spec formatted as `prometheus://namespace/service`,
+// e.g. `prometheus://monitoring/prometheus:web`, and returns a backend that
+// queries it through the apiserver proxy.
+func newPrometheusBackend(spec string) (*prometheusBackend, error) {
+	subs := prometheusre.FindStringSubmatch(spec)
+	if len(subs) != 3 {
+		return nil, fmt.Errorf("invalid Prometheus spec: %q", spec)
+	}
+	return &prometheusBackend{namespace: subs[1], service: subs[2]}, nil
+}
+
+func (b *prometheusBackend) Name() string {
+	return fmt.Sprintf("prometheus://%s/%s", b.namespace, b.service)
+}
+
+// prometheusQueryResponse is the subset of a Prometheus HTTP API query
+// response that we care about.
+type prometheusQueryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Metric map[string]string `json:"metric"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// FetchExtensions queries Prometheus, through the apiserver's proxy to the
+// Prometheus service, for the extension name/value pairs recorded for
+// clusterID.
+func (b *prometheusBackend) FetchExtensions(ctx context.Context, clusterID string) (map[string]string, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes client: %v", err)
+	}
+
+	query := fmt.Sprintf(`tectonic_stats_extension{clusterID=%q}`, clusterID)
+	raw, err := c.Core().RESTClient().Get().
+		Namespace(b.namespace).
+		Resource("services").
+		Name(b.service).
+		SubResource("proxy").
+		Suffix("api/v1/query").
+		Param("query", query).
+		Context(ctx).
+		DoRaw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Prometheus: %v", err)
+	}
+
+	var resp prometheusQueryResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse Prometheus response: %v", err)
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("Prometheus query did not succeed: status %q", resp.Status)
+	}
+
+	found := make(map[string]string)
+	for _, result := range resp.Data.Result {
+		name, ok := result.Metric["extension"]
+		if !ok {
+			continue
+		}
+		found[name] = result.Metric["extensionValue"]
+	}
+	return found, nil
+}